@@ -2,39 +2,151 @@ package main
 
 import (
 	"bufio"
+	"crypto/subtle"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Example SSE server in Golang.
 //     $ go run sse.go
 
+// wildcardTopic is the topic bucket for clients that didn't filter by topic
+// (a plain GET with no path segment or ?topics= query) and is also where
+// SendMessage publishes, so legacy, non-topic-aware producers keep reaching
+// every connected client.
+const wildcardTopic = "*"
+
+const (
+	// clientBufferSize is how many undelivered events a client's channel
+	// will hold before it's considered slow and evicted.
+	clientBufferSize = 16
+
+	// keepAliveInterval is how often an idle connection gets a comment
+	// frame, to stop proxies from closing it for inactivity.
+	keepAliveInterval = 15 * time.Second
+
+	// writeTimeout bounds how long a single write to a client may take
+	// before that client is considered stalled and evicted.
+	writeTimeout = 5 * time.Second
+
+	// evictGracePeriod bounds how long the broadcast loop will wait for
+	// room in a full client channel before giving up and evicting it. A
+	// client that's actively draining just got outrun momentarily by a
+	// burst of events; one that's still full after the grace period is
+	// genuinely stalled.
+	evictGracePeriod = 50 * time.Millisecond
+
+	// maxPublishBodySize caps how much of a POST /publish body is read, so
+	// a careless producer can't exhaust memory with one request.
+	maxPublishBodySize = 1 << 20
+
+	// maxNetstringLength caps the payload size a netstring frame's length
+	// prefix may declare, so a bogus or hostile prefix can't force a huge
+	// or negative allocation.
+	maxNetstringLength = 1 << 20
+)
+
+// Message is a single structured SSE event published through a Broker.
+// Kind categorizes the event for producers (e.g. "init", "update", "create",
+// "delete"); Event is the SSE event name clients subscribe to with
+// EventSource.addEventListener. Data is JSON-encoded into the "data:" frame.
+type Message struct {
+	Kind  string
+	Event string
+	Topic string
+	ID    uint64
+	Data  any
+
+	// Retry is the SSE reconnection time in milliseconds, emitted as a
+	// "retry:" frame field when non-zero.
+	Retry int
+}
+
+// subscriber is a client's registration request: its message channel plus
+// the set of topics it wants to receive. An empty topics set subscribes to
+// wildcardTopic, i.e. every message.
+type subscriber struct {
+	ch     chan Message
+	topics map[string]bool
+}
+
 type Broker struct {
 
 	// Events are pushed to this channel by the main events-gathering routine
-	Notifier chan []byte
+	Notifier chan Message
 
 	// New client connections
-	newClients chan chan []byte
+	newClients chan subscriber
 
 	// Closed client connections
-	closingClients chan chan []byte
+	closingClients chan chan Message
+
+	// Client connections registry, keyed by topic. A client subscribed to
+	// multiple topics is registered under each of them.
+	clients map[string]map[chan Message]bool
+
+	// clientTopics tracks which topic buckets each client channel was
+	// registered under, so closingClients can remove it from all of them.
+	clientTopics map[chan Message]map[string]bool
+
+	// lastID is the highest event ID handed out or seen by PublishMessage.
+	lastID uint64
+
+	// clientCount is the number of distinct connected clients, maintained by
+	// listen() and read by ClientCount.
+	clientCount int64
+
+	// bufferSize is the maximum number of events retained for replay.
+	bufferSize int
 
-	// Client connections registry
-	clients map[chan []byte]bool
+	// bufferTTL is how long a buffered event remains eligible for replay.
+	bufferTTL time.Duration
+
+	// bufMu guards buffer.
+	bufMu sync.Mutex
+
+	// buffer holds the last bufferSize emitted events for Last-Event-ID replay.
+	buffer []bufferedMessage
+
+	// publishPath is the path POST /publish requests are mounted on; a
+	// trailing /{topic} segment targets that topic instead of wildcardTopic.
+	publishPath string
+
+	// token, when non-empty, is the shared-secret bearer token POST
+	// /publish requests must present to be accepted.
+	token string
+}
+
+// bufferedMessage is a Message tagged with the time it was buffered, so
+// expired entries can be dropped once bufferTTL has elapsed.
+type bufferedMessage struct {
+	Message
+	storedAt time.Time
 }
 
-func NewServer() (broker *Broker) {
+func NewServer(bufferSize int, bufferTTL time.Duration, publishPath, token string) (broker *Broker) {
 	// Instantiate a broker
 	broker = &Broker{
-		Notifier:       make(chan []byte, 1),
-		newClients:     make(chan chan []byte),
-		closingClients: make(chan chan []byte),
-		clients:        make(map[chan []byte]bool),
+		Notifier:       make(chan Message, 1),
+		newClients:     make(chan subscriber),
+		closingClients: make(chan chan Message),
+		clients:        make(map[string]map[chan Message]bool),
+		clientTopics:   make(map[chan Message]map[string]bool),
+		bufferSize:     bufferSize,
+		bufferTTL:      bufferTTL,
+		publishPath:    publishPath,
+		token:          token,
 	}
 
 	// Set it running - listening and broadcasting events
@@ -43,7 +155,274 @@ func NewServer() (broker *Broker) {
 	return
 }
 
+// bufferEvent appends msg to the replay buffer, dropping expired or
+// over-capacity entries.
+func (broker *Broker) bufferEvent(msg Message) {
+	broker.bufMu.Lock()
+	defer broker.bufMu.Unlock()
+
+	broker.buffer = append(broker.buffer, bufferedMessage{Message: msg, storedAt: time.Now()})
+
+	cutoff := time.Now().Add(-broker.bufferTTL)
+	i := 0
+	for ; i < len(broker.buffer); i++ {
+		if broker.buffer[i].storedAt.After(cutoff) {
+			break
+		}
+	}
+	broker.buffer = broker.buffer[i:]
+
+	if excess := len(broker.buffer) - broker.bufferSize; excess > 0 {
+		broker.buffer = broker.buffer[excess:]
+	}
+}
+
+// replaySince returns the buffered events with an ID greater than lastID
+// that match topics, in the order they were originally emitted. An empty
+// topics set matches every buffered event.
+func (broker *Broker) replaySince(lastID uint64, topics map[string]bool) []Message {
+	broker.bufMu.Lock()
+	defer broker.bufMu.Unlock()
+
+	var replay []Message
+	for _, buffered := range broker.buffer {
+		if buffered.ID <= lastID {
+			continue
+		}
+		if len(topics) == 0 || topics[buffered.Topic] || buffered.Topic == wildcardTopic {
+			replay = append(replay, buffered.Message)
+		}
+	}
+	return replay
+}
+
+// ClientCount returns the number of distinct connected clients, regardless
+// of how many topics each one subscribes to.
+func (broker *Broker) ClientCount() int {
+	return int(atomic.LoadInt64(&broker.clientCount))
+}
+
+// lastEventID extracts the Last-Event-ID the client is resuming from, per
+// the SSE reconnection spec, checking the standard header first and falling
+// back to a ?lastEventId= query parameter for clients that can't set
+// headers (e.g. plain EventSource in some environments).
+func lastEventID(req *http.Request) uint64 {
+	raw := req.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = req.URL.Query().Get("lastEventId")
+	}
+	id, _ := strconv.ParseUint(raw, 10, 64)
+	return id
+}
+
+// parseTopics extracts the topics a client wants to subscribe to, from a
+// comma-separated ?topics=a,b,c query parameter or a /events/{topic} path
+// segment. An empty result means "subscribe to everything".
+func parseTopics(req *http.Request) map[string]bool {
+	topics := make(map[string]bool)
+
+	if raw := req.URL.Query().Get("topics"); raw != "" {
+		for _, t := range strings.Split(raw, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				topics[t] = true
+			}
+		}
+	}
+
+	// The bare "/events" route (no topic segment) means "everything"; any
+	// other path's last segment is the topic, even if that topic happens
+	// to be named "events" itself (e.g. "/events/events").
+	if path := strings.Trim(req.URL.Path, "/"); path != "" && path != "events" {
+		if topic := path[strings.LastIndex(path, "/")+1:]; topic != "" {
+			topics[topic] = true
+		}
+	}
+
+	return topics
+}
+
+// Publish sends a structured domain event of the given kind to the
+// subscribers of topic. data is JSON-encoded into the event's "data:" frame
+// and the event is assigned a monotonically increasing ID.
+func (broker *Broker) Publish(topic, kind string, data any) {
+	broker.PublishMessage(Message{Kind: kind, Topic: topic, Data: data})
+}
+
+// SendMessage publishes kind/data to every connected client, regardless of
+// topic. It exists for producers, such as the STDIN reader, that don't have
+// a notion of topics.
+func (broker *Broker) SendMessage(kind string, data any) {
+	broker.PublishMessage(Message{Kind: kind, Data: data})
+}
+
+// eventNameUnsafe matches any character not allowed in an SSE event name.
+// In particular it strips CR/LF, which would otherwise let an externally
+// supplied Event (e.g. from servePublish or the jsonl STDIN codec) break
+// out of its "event:" line and inject forged frames into the stream.
+var eventNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.:-]`)
+
+// sanitizeEventName strips everything but a safe charset from an
+// externally-supplied event name before it's ever written to the wire.
+func sanitizeEventName(name string) string {
+	return eventNameUnsafe.ReplaceAllString(name, "")
+}
+
+// PublishMessage publishes a fully-formed Message, filling in Topic, Event
+// and ID where the caller left them zero. This is the entry point used by
+// input codecs (e.g. the jsonl STDIN format) and servePublish that read
+// those fields directly off the wire instead of deriving them from a kind
+// string, so it's also where untrusted input gets sanitized and folded
+// into the ID sequence before reaching a client.
+func (broker *Broker) PublishMessage(msg Message) {
+	if msg.Topic == "" {
+		msg.Topic = wildcardTopic
+	}
+	if msg.Event == "" {
+		msg.Event = msg.Kind
+	}
+	msg.Event = sanitizeEventName(msg.Event)
+
+	if msg.ID == 0 {
+		msg.ID = atomic.AddUint64(&broker.lastID, 1)
+	} else {
+		// An externally supplied ID (servePublish, jsonl) must still bump
+		// lastID, or a later auto-assigned event could get a lower ID than
+		// one already seen by a client, which replaySince would then skip
+		// forever on that client's next Last-Event-ID reconnect.
+		for {
+			last := atomic.LoadUint64(&broker.lastID)
+			if msg.ID <= last {
+				break
+			}
+			if atomic.CompareAndSwapUint64(&broker.lastID, last, msg.ID) {
+				break
+			}
+		}
+	}
+
+	broker.bufferEvent(msg)
+	broker.Notifier <- msg
+}
+
+// writeMessage JSON-encodes msg.Data and writes it to rw as an SSE frame.
+func writeMessage(rw http.ResponseWriter, msg Message) error {
+	payload, err := json.Marshal(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	// Server Sent Events compatible
+	if msg.Retry > 0 {
+		if _, err := fmt.Fprintf(rw, "retry: %d\n", msg.Retry); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(rw, "event: %s\nid: %d\ndata: %s\n\n", msg.Event, msg.ID, payload)
+	return err
+}
+
+// writeWithTimeout bounds write by a per-write deadline on the underlying
+// connection, so a stalled client can't wedge its ServeHTTP goroutine
+// forever. If rw doesn't support write deadlines, write runs unbounded.
+func writeWithTimeout(rw http.ResponseWriter, write func() error) error {
+	rc := http.NewResponseController(rw)
+	if err := rc.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil && err != http.ErrNotSupported {
+		return err
+	}
+	return write()
+}
+
+// ServeHTTP routes POST requests under publishPath to servePublish and
+// treats everything else as a client subscribing to the SSE stream.
 func (broker *Broker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost && broker.isPublishPath(req.URL.Path) {
+		broker.servePublish(rw, req)
+		return
+	}
+	broker.serveEvents(rw, req)
+}
+
+// isPublishPath reports whether path is the publish endpoint itself or a
+// /{topic} segment beneath it.
+func (broker *Broker) isPublishPath(path string) bool {
+	return path == broker.publishPath || strings.HasPrefix(path, broker.publishPath+"/")
+}
+
+// authorized reports whether req carries the configured bearer token. A
+// broker with no token configured accepts every request. The comparison is
+// constant-time so a caller can't use response timing to guess the token
+// byte by byte.
+func (broker *Broker) authorized(req *http.Request) bool {
+	if broker.token == "" {
+		return true
+	}
+
+	const prefix = "Bearer "
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+
+	supplied := strings.TrimPrefix(header, prefix)
+	return subtle.ConstantTimeCompare([]byte(supplied), []byte(broker.token)) == 1
+}
+
+// servePublish lets external producers inject an event over plain HTTP
+// instead of piping it through STDIN. The topic comes from a /{topic} path
+// segment beneath publishPath, defaulting to wildcardTopic. A body sent with
+// an application/json Content-Type is decoded as a jsonlFrame and sets
+// event/id/data/retry directly (an undecodable one is rejected with 400);
+// a body of any other Content-Type is published as a raw string, even if it
+// happens to be JSON. The X-SSE-Event and X-SSE-Id headers, when
+// present, override the event name and ID from either source.
+func (broker *Broker) servePublish(rw http.ResponseWriter, req *http.Request) {
+	if !broker.authorized(req) {
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPublishBodySize))
+	if err != nil {
+		http.Error(rw, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	msg := Message{Topic: strings.Trim(strings.TrimPrefix(req.URL.Path, broker.publishPath), "/")}
+	if msg.Topic == "" {
+		msg.Topic = wildcardTopic
+	}
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		var frame jsonlFrame
+		if err := json.Unmarshal(body, &frame); err != nil {
+			http.Error(rw, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		msg.Event, msg.ID, msg.Data, msg.Retry = frame.Event, frame.ID, frame.Data, frame.Retry
+	} else {
+		msg.Data = string(body)
+	}
+
+	if event := req.Header.Get("X-SSE-Event"); event != "" {
+		msg.Event = event
+	}
+	if id := req.Header.Get("X-SSE-Id"); id != "" {
+		if parsed, err := strconv.ParseUint(id, 10, 64); err == nil {
+			msg.ID = parsed
+		}
+	}
+
+	if msg.Event == "" {
+		msg.Event = "message"
+	}
+	msg.Kind = msg.Event
+
+	broker.PublishMessage(msg)
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (broker *Broker) serveEvents(rw http.ResponseWriter, req *http.Request) {
 
 	// Make sure that the writer supports flushing.
 	//
@@ -59,11 +438,25 @@ func (broker *Broker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	rw.Header().Set("Connection", "keep-alive")
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
 
-	// Each connection registers its own message channel with the Broker's connections registry
-	messageChan := make(chan []byte)
+	topics := parseTopics(req)
+
+	// Replay any buffered events the client missed while disconnected,
+	// per the SSE Last-Event-ID reconnection semantics.
+	for _, msg := range broker.replaySince(lastEventID(req), topics) {
+		if err := writeWithTimeout(rw, func() error { return writeMessage(rw, msg) }); err != nil {
+			log.Printf("sse: client write timed out replaying event %d: %v", msg.ID, err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	// Each connection registers its own message channel with the Broker's
+	// connections registry. It's buffered so a momentarily slow client
+	// doesn't block the broadcast loop; see listen()'s non-blocking send.
+	messageChan := make(chan Message, clientBufferSize)
 
 	// Signal the broker that we have a new connection
-	broker.newClients <- messageChan
+	broker.newClients <- subscriber{ch: messageChan, topics: topics}
 
 	// Remove this client from the map of connected clients
 	// when this handler exits.
@@ -79,14 +472,35 @@ func (broker *Broker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		broker.closingClients <- messageChan
 	}()
 
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
 	for {
+		select {
+		case msg, ok := <-messageChan:
+			if !ok {
+				// The broker evicted us, most likely for being too slow
+				// to keep up with the broadcast.
+				return
+			}
 
-		// Write to the ResponseWriter
-		// Server Sent Events compatible
-		fmt.Fprintf(rw, "data: %s\n\n", <-messageChan)
+			if err := writeWithTimeout(rw, func() error { return writeMessage(rw, msg) }); err != nil {
+				log.Printf("sse: client write timed out on event %d: %v", msg.ID, err)
+				return
+			}
 
-		// Flush the data immediatly instead of buffering it for later.
-		flusher.Flush()
+			// Flush the data immediatly instead of buffering it for later.
+			flusher.Flush()
+		case <-keepAlive.C:
+			if err := writeWithTimeout(rw, func() error {
+				_, err := fmt.Fprint(rw, ": ping\n\n")
+				return err
+			}); err != nil {
+				log.Printf("sse: client write timed out on keep-alive: %v", err)
+				return
+			}
+			flusher.Flush()
+		}
 	}
 
 }
@@ -94,33 +508,207 @@ func (broker *Broker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 func (broker *Broker) listen() {
 	for {
 		select {
-		case s := <-broker.newClients:
-
-			// A new client has connected.
-			// Register their message channel
-			broker.clients[s] = true
-		case s := <-broker.closingClients:
+		case sub := <-broker.newClients:
+
+			// A new client has connected. Register their message channel
+			// under every topic they subscribed to, defaulting to
+			// wildcardTopic if they didn't specify any.
+			topics := sub.topics
+			if len(topics) == 0 {
+				topics = map[string]bool{wildcardTopic: true}
+			}
+			for topic := range topics {
+				if broker.clients[topic] == nil {
+					broker.clients[topic] = make(map[chan Message]bool)
+				}
+				broker.clients[topic][sub.ch] = true
+			}
+			broker.clientTopics[sub.ch] = topics
+			atomic.AddInt64(&broker.clientCount, 1)
+		case ch := <-broker.closingClients:
 
 			// A client has dettached and we want to
 			// stop sending them messages.
-			delete(broker.clients, s)
+			broker.evict(ch)
 		case event := <-broker.Notifier:
 
-			// We got a new event from the outside!
-			// Send event to all connected clients
-			for clientMessageChan, _ := range broker.clients {
-				clientMessageChan <- event
+			// We got a new event from the outside! Send it to every
+			// subscriber of its topic, plus every wildcard subscriber,
+			// without delivering twice to a client subscribed to both.
+			// A wildcardTopic event goes to every client, whatever it
+			// subscribed to.
+			buckets := []map[chan Message]bool{broker.clients[event.Topic], broker.clients[wildcardTopic]}
+			if event.Topic == wildcardTopic {
+				buckets = buckets[:0]
+				for _, bucket := range broker.clients {
+					buckets = append(buckets, bucket)
+				}
+			}
+			sent := make(map[chan Message]bool)
+			for _, bucket := range buckets {
+				for clientMessageChan := range bucket {
+					if sent[clientMessageChan] {
+						continue
+					}
+					sent[clientMessageChan] = true
+
+					// A client whose buffer is already full gets a brief
+					// grace period to drain before we give up on it, so a
+					// momentarily-behind but actively-draining client
+					// isn't evicted just for losing a scheduling race
+					// during a burst. A genuinely stalled client still
+					// can't backpressure the broker for more than that.
+					select {
+					case clientMessageChan <- event:
+					default:
+						select {
+						case clientMessageChan <- event:
+						case <-time.After(evictGracePeriod):
+							log.Printf("sse: evicting slow client")
+							broker.evict(clientMessageChan)
+						}
+					}
+				}
+			}
+		}
+	}
+
+}
+
+// evict unregisters ch from every topic it's subscribed to and closes it,
+// waking up any ServeHTTP goroutine blocked reading from it. It's a no-op
+// if ch was already evicted.
+func (broker *Broker) evict(ch chan Message) {
+	topics, ok := broker.clientTopics[ch]
+	if !ok {
+		return
+	}
+
+	for topic := range topics {
+		delete(broker.clients[topic], ch)
+	}
+	delete(broker.clientTopics, ch)
+	atomic.AddInt64(&broker.clientCount, -1)
+	close(ch)
+}
+
+// jsonlFrame is the shape of one line in the "jsonl" STDIN format. Fields
+// left out of a line fall back to the same defaults as the "raw" format.
+type jsonlFrame struct {
+	Event string `json:"event"`
+	ID    uint64 `json:"id"`
+	Data  any    `json:"data"`
+	Retry int    `json:"retry"`
+}
+
+// readStdin feeds events from os.Stdin into broker, decoding them per
+// format: "raw" treats each line as an opaque string message (the
+// default), "jsonl" parses each line as a jsonlFrame, and "netstring"
+// reads length-prefixed frames so payloads may contain raw newlines.
+func readStdin(broker *Broker, format string, verbose bool) {
+	switch format {
+	case "jsonl":
+		readStdinJSONL(broker, verbose)
+	case "netstring":
+		readStdinNetstrings(broker, verbose)
+	default:
+		readStdinRaw(broker, verbose)
+	}
+}
+
+func readStdinRaw(broker *Broker, verbose bool) {
+	scan := bufio.NewScanner(os.Stdin)
+	for scan.Scan() {
+		broker.SendMessage("message", scan.Text())
+		if verbose {
+			logReceived(broker, scan.Bytes())
+		}
+	}
+}
+
+func readStdinJSONL(broker *Broker, verbose bool) {
+	scan := bufio.NewScanner(os.Stdin)
+	for scan.Scan() {
+		line := scan.Bytes()
+
+		var frame jsonlFrame
+		if err := json.Unmarshal(line, &frame); err != nil {
+			log.Printf("stdin: skipping invalid jsonl line: %v", err)
+			continue
+		}
+
+		kind := frame.Event
+		if kind == "" {
+			kind = "message"
+		}
+		broker.PublishMessage(Message{Kind: kind, Event: kind, ID: frame.ID, Data: frame.Data, Retry: frame.Retry})
+
+		if verbose {
+			logReceived(broker, line)
+		}
+	}
+}
+
+func readStdinNetstrings(broker *Broker, verbose bool) {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		payload, err := readNetstring(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("stdin: netstring read error: %v", err)
 			}
+			return
+		}
+
+		broker.SendMessage("message", string(payload))
+		if verbose {
+			logReceived(broker, payload)
 		}
 	}
+}
 
+// readNetstring reads one netstring-framed ("<length>:<payload>,") message
+// from r. Unlike newline-delimited framing this is binary-safe: the payload
+// may itself contain newlines.
+func readNetstring(r *bufio.Reader) ([]byte, error) {
+	lengthField, err := r.ReadString(':')
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := strconv.Atoi(strings.TrimSuffix(lengthField, ":"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid netstring length %q: %w", lengthField, err)
+	}
+	if length < 0 || length > maxNetstringLength {
+		return nil, fmt.Errorf("netstring length %d out of range (0-%d)", length, maxNetstringLength)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if trailer, err := r.ReadByte(); err != nil {
+		return nil, err
+	} else if trailer != ',' {
+		return nil, fmt.Errorf("netstring: expected trailing ',', got %q", trailer)
+	}
+
+	return payload, nil
+}
+
+// logReceived prints the verbose-mode trace line shared by every STDIN codec.
+func logReceived(broker *Broker, payload []byte) {
+	currentTime := time.Now().Local()
+	fmt.Printf("[%s] %d clients: %s\n", currentTime.Format("2006-01-02 15:04:05"), broker.ClientCount(), payload)
 }
 
 func PromptHandler(broker *Broker) {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
-		fmt.Printf("(%d clients)-> ", len(broker.clients))
+		fmt.Printf("(%d clients)-> ", broker.ClientCount())
 		line, _, err := reader.ReadLine()
 		if err != nil {
 			fmt.Println(err)
@@ -128,7 +716,7 @@ func PromptHandler(broker *Broker) {
 
 		if len(line) > 0 {
 			fmt.Printf("Sent message: %s\n", string(line))
-			broker.Notifier <- []byte(line)
+			broker.SendMessage("message", string(line))
 		}
 	}
 }
@@ -138,29 +726,24 @@ func main() {
 	promptPtr := flag.Bool("p", false, "Show prompt for message which send to clients")
 	addrPtr := flag.String("l", "localhost:3000", "Listening address and port")
 	verbosePtr := flag.Bool("v", false, "Verbose debug messages")
+	bufferSizePtr := flag.Int("buffer-size", 100, "Number of past events retained for Last-Event-ID replay")
+	bufferTTLPtr := flag.Duration("buffer-ttl", 5*time.Minute, "How long a past event stays eligible for Last-Event-ID replay")
+	formatPtr := flag.String("format", "raw", "STDIN input format: raw, jsonl, or netstring")
+	publishPathPtr := flag.String("publish-path", "/publish", "Path external producers POST events to")
+	tokenPtr := flag.String("token", "", "Bearer token required on POST /publish requests (disabled if empty)")
 	flag.CommandLine.Parse(os.Args[1:])
 
 	if *verbosePtr {
 		fmt.Println("Verbose mode on")
 	}
 
-	broker := NewServer()
+	broker := NewServer(*bufferSizePtr, *bufferTTLPtr, *publishPathPtr, *tokenPtr)
 
 	if *promptPtr {
 		go PromptHandler(broker)
 	} else {
 		fmt.Println("Reading from STDIN")
-		go func() {
-			scan := bufio.NewScanner(os.Stdin)
-			for scan.Scan() {
-				broker.Notifier <- scan.Bytes()
-
-				if *verbosePtr {
-					currentTime := time.Now().Local()
-					fmt.Printf("[%s] %d clients: %s\n", currentTime.Format("2006-01-02 15:04:05"), len(broker.clients), scan.Bytes())
-				}
-			}
-		}()
+		go readStdin(broker, *formatPtr, *verbosePtr)
 	}
 
 	fmt.Println("Listening on ", *addrPtr)
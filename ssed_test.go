@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTopicsTopicNamedEvents(t *testing.T) {
+	req := httptest.NewRequest("GET", "/events/events", nil)
+	topics := parseTopics(req)
+	if !topics["events"] || len(topics) != 1 {
+		t.Fatalf("want a subscription to the literal topic %q, got %v", "events", topics)
+	}
+
+	bare := httptest.NewRequest("GET", "/events", nil)
+	if topics := parseTopics(bare); len(topics) != 0 {
+		t.Fatalf("want no topics (wildcard) for the bare /events route, got %v", topics)
+	}
+}
+
+func TestReplaySinceFiltersByTopic(t *testing.T) {
+	broker := NewServer(100, time.Minute, "/publish", "")
+
+	broker.Publish("a", "create", 1)
+	broker.Publish("a", "update", 2)
+	broker.Publish("b", "create", 3)
+
+	onlyA := broker.replaySince(0, map[string]bool{"a": true})
+	if len(onlyA) != 2 {
+		t.Fatalf("want 2 events for topic a, got %d", len(onlyA))
+	}
+	for _, msg := range onlyA {
+		if msg.Topic != "a" {
+			t.Errorf("replaySince leaked topic %q into an \"a\" subscription", msg.Topic)
+		}
+	}
+
+	all := broker.replaySince(0, nil)
+	if len(all) != 3 {
+		t.Fatalf("want 3 events with no topic filter, got %d", len(all))
+	}
+
+	sinceFirst := broker.replaySince(onlyA[0].ID, map[string]bool{"a": true})
+	if len(sinceFirst) != 1 || sinceFirst[0].Event != "update" {
+		t.Fatalf("want only the update event after the first ID, got %+v", sinceFirst)
+	}
+}
+
+// TestSlowClientEvictionDoesNotBlockOtherSubscribers drives the broker with
+// a client that never drains its channel alongside one that does, and
+// checks that the slow client gets evicted (closed) instead of the
+// non-blocking send in listen() backing up and starving the fast client.
+func TestSlowClientEvictionDoesNotBlockOtherSubscribers(t *testing.T) {
+	broker := NewServer(100, time.Minute, "/publish", "")
+
+	slow := make(chan Message, clientBufferSize)
+	fast := make(chan Message, clientBufferSize)
+	broker.newClients <- subscriber{ch: slow, topics: nil}
+	broker.newClients <- subscriber{ch: fast, topics: nil}
+
+	received := make(chan int, 1)
+	go func() {
+		count := 0
+		for range fast {
+			count++
+		}
+		received <- count
+	}()
+
+	const total = clientBufferSize * 3
+	for i := 0; i < total; i++ {
+		broker.Publish(wildcardTopic, "tick", i)
+	}
+
+	// slow never drains its own buffer, so the first clientBufferSize sends
+	// land there before listen() starts evicting it; drain those off before
+	// expecting the close that signals eviction.
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-slow:
+			if !ok {
+				goto evicted
+			}
+		case <-deadline:
+			t.Fatal("slow client was never evicted; the broadcast loop is likely blocked on it")
+		}
+	}
+evicted:
+
+	// Give the broker a beat to finish fanning out to fast, then evict it
+	// too so the draining goroutine above can return its count.
+	time.Sleep(50 * time.Millisecond)
+	broker.closingClients <- fast
+
+	if got := <-received; got != total {
+		t.Fatalf("fast client should have received all %d events despite the slow client, got %d", total, got)
+	}
+}
+
+// TestServePublishAuthAndRouting checks that servePublish rejects requests
+// without the bearer token and that an authorized POST to /publish/{topic}
+// is routed to subscribers of that topic with the JSON body decoded into
+// the published Message.
+func TestServePublishAuthAndRouting(t *testing.T) {
+	broker := NewServer(100, time.Minute, "/publish", "secret")
+
+	unauthorized := httptest.NewRequest("POST", "/publish/orders", strings.NewReader("{}"))
+	rw := httptest.NewRecorder()
+	broker.ServeHTTP(rw, unauthorized)
+	if rw.Code != 401 {
+		t.Fatalf("want 401 for a request without the bearer token, got %d", rw.Code)
+	}
+
+	sub := make(chan Message, clientBufferSize)
+	broker.newClients <- subscriber{ch: sub, topics: map[string]bool{"orders": true}}
+	defer func() { broker.closingClients <- sub }()
+
+	body := `{"event":"created","data":"widget"}`
+	authorized := httptest.NewRequest("POST", "/publish/orders", strings.NewReader(body))
+	authorized.Header.Set("Content-Type", "application/json")
+	authorized.Header.Set("Authorization", "Bearer secret")
+	rw = httptest.NewRecorder()
+	broker.ServeHTTP(rw, authorized)
+	if rw.Code != 202 {
+		t.Fatalf("want 202 for an authorized publish, got %d", rw.Code)
+	}
+
+	select {
+	case msg := <-sub:
+		if msg.Topic != "orders" || msg.Event != "created" || msg.Data != "widget" {
+			t.Fatalf("want {orders created widget}, got %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscriber never received the published event")
+	}
+}